@@ -0,0 +1,340 @@
+// Package chaos injects configurable faults (latency, errors, truncated
+// bodies, upstream connection failures) into the /unstable route, so k6 runs
+// against this app produce failures that are interesting to chase through
+// Tempo/Loki/Grafana.
+package chaos
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/paluszkiewiczB/k6-grafana-stack/httpmw"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Kind identifies a fault strategy for logging and the chaos.kind span
+// attribute.
+type Kind string
+
+const (
+	KindLatency  Kind = "latency"
+	KindError    Kind = "error"
+	KindTruncate Kind = "truncate"
+	KindConnFail Kind = "conn_fail"
+)
+
+// Distribution is a latency sampling shape.
+type Distribution string
+
+const (
+	DistUniform   Distribution = "uniform"
+	DistNormal    Distribution = "normal"
+	DistLognormal Distribution = "lognormal"
+	DistPareto    Distribution = "pareto"
+)
+
+// LatencyPolicy configures the delay injected before every /unstable
+// response. MeanMs <= 0 disables latency injection.
+type LatencyPolicy struct {
+	Distribution Distribution `json:"distribution"`
+	MeanMs       float64      `json:"mean_ms"`
+	StdDevMs     float64      `json:"stddev_ms"`
+}
+
+// ErrorPolicy probabilistically short-circuits the response with one of the
+// configured statuses. Rate <= 0 disables error injection.
+type ErrorPolicy struct {
+	Rate    float64         `json:"rate"`
+	Weights map[int]float64 `json:"weights"`
+}
+
+// TruncatePolicy probabilistically cuts the response body short and closes
+// the connection, simulating a client seeing an unexpected EOF.
+type TruncatePolicy struct {
+	Rate     float64 `json:"rate"`
+	MinBytes int     `json:"min_bytes"`
+	MaxBytes int     `json:"max_bytes"`
+}
+
+// ConnFailPolicy probabilistically makes outbound calls dial a bogus port,
+// simulating the upstream being unreachable.
+type ConnFailPolicy struct {
+	Rate float64 `json:"rate"`
+}
+
+// Policy is the full fault profile applied to /unstable traffic.
+type Policy struct {
+	Latency  LatencyPolicy  `json:"latency"`
+	Error    ErrorPolicy    `json:"error"`
+	Truncate TruncatePolicy `json:"truncate"`
+	ConnFail ConnFailPolicy `json:"conn_fail"`
+}
+
+// Store holds the policy currently in effect and allows it to be hot-reloaded
+// (e.g. from the /admin/chaos endpoint) without restarting the app.
+type Store struct {
+	v atomic.Value
+}
+
+// NewStore creates a Store seeded with the given policy.
+func NewStore(initial Policy) *Store {
+	s := &Store{}
+	s.v.Store(initial)
+	return s
+}
+
+// Load returns the currently active policy.
+func (s *Store) Load() Policy {
+	return s.v.Load().(Policy)
+}
+
+// Set replaces the active policy.
+func (s *Store) Set(p Policy) {
+	s.v.Store(p)
+}
+
+// Injector is a single pluggable fault strategy run by Middleware in order.
+// It rolls policy's corresponding fault; if that fires it may wrap w to act
+// on the response later (e.g. injectTruncate) and/or write the response
+// itself and signal halt so Middleware stops before calling the next handler
+// (e.g. injectError). It returns w unchanged and halt false otherwise.
+//
+// ConnFailPolicy has no Injector: it operates on outbound requests via
+// DialFailTransport, a http.RoundTripper, which doesn't fit this
+// http.ResponseWriter-shaped interface.
+type Injector interface {
+	Inject(policy Policy, w http.ResponseWriter, r *http.Request, span trace.Span, l *zap.Logger) (next http.ResponseWriter, halt bool)
+}
+
+// InjectorFunc adapts a plain function to Injector.
+type InjectorFunc func(policy Policy, w http.ResponseWriter, r *http.Request, span trace.Span, l *zap.Logger) (http.ResponseWriter, bool)
+
+func (f InjectorFunc) Inject(policy Policy, w http.ResponseWriter, r *http.Request, span trace.Span, l *zap.Logger) (http.ResponseWriter, bool) {
+	return f(policy, w, r, span, l)
+}
+
+// injectors runs in this order on every /unstable request: latency first so
+// it delays the rest, then error (which may halt), then truncate last so it
+// wraps whatever ResponseWriter the earlier injectors left behind.
+var injectors = []Injector{
+	InjectorFunc(injectLatency),
+	InjectorFunc(injectError),
+	InjectorFunc(injectTruncate),
+}
+
+// Middleware runs the injectors against every request under store's current
+// policy, recording an OTel span event for each fault that fires.
+func Middleware(store *Store, l *zap.Logger) httpmw.Decorator {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy := store.Load()
+			span := trace.SpanFromContext(r.Context())
+
+			for _, inj := range injectors {
+				var halt bool
+				w, halt = inj.Inject(policy, w, r, span, l)
+				if halt {
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func injectLatency(policy Policy, w http.ResponseWriter, r *http.Request, span trace.Span, l *zap.Logger) (http.ResponseWriter, bool) {
+	fired, ms := rollLatency(policy.Latency)
+	if !fired {
+		return w, false
+	}
+	span.AddEvent("chaos", trace.WithAttributes(
+		attribute.String("chaos.kind", string(KindLatency)),
+		attribute.Int64("chaos.delay_ms", ms),
+	))
+	l.Info("chaos: injecting latency", zap.Int64("delay_ms", ms))
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	return w, false
+}
+
+func injectError(policy Policy, w http.ResponseWriter, r *http.Request, span trace.Span, l *zap.Logger) (http.ResponseWriter, bool) {
+	fired, status := rollError(policy.Error)
+	if !fired {
+		return w, false
+	}
+	span.AddEvent("chaos", trace.WithAttributes(
+		attribute.String("chaos.kind", string(KindError)),
+		attribute.Int("chaos.status", status),
+	))
+	l.Info("chaos: injecting error", zap.Int("status", status))
+	w.WriteHeader(status)
+	return w, true
+}
+
+func injectTruncate(policy Policy, w http.ResponseWriter, r *http.Request, span trace.Span, l *zap.Logger) (http.ResponseWriter, bool) {
+	fired, n := rollTruncate(policy.Truncate)
+	if !fired {
+		return w, false
+	}
+	span.AddEvent("chaos", trace.WithAttributes(
+		attribute.String("chaos.kind", string(KindTruncate)),
+		attribute.Int("chaos.truncate_bytes", n),
+	))
+	l.Info("chaos: truncating response body", zap.Int("bytes", n))
+	return &truncatingWriter{ResponseWriter: w, limit: n}, false
+}
+
+// DialFailTransport wraps base so that, per store's conn_fail policy, a
+// fraction of outbound requests are redirected to a bogus port before being
+// handed to base, causing the dial to fail.
+type DialFailTransport struct {
+	Base  http.RoundTripper
+	Store *Store
+}
+
+func (t *DialFailTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	policy := t.Store.Load()
+	if !rollConnFail(policy.ConnFail) {
+		return t.Base.RoundTrip(r)
+	}
+
+	span := trace.SpanFromContext(r.Context())
+	span.AddEvent("chaos", trace.WithAttributes(attribute.String("chaos.kind", string(KindConnFail))))
+
+	bogus := r.Clone(r.Context())
+	bogusURL := *bogus.URL
+	bogusURL.Host = bogusHost(bogusURL.Host)
+	bogus.URL = &bogusURL
+	bogus.Host = bogusURL.Host
+	return t.Base.RoundTrip(bogus)
+}
+
+func bogusHost(host string) string {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		h = host
+	}
+	return net.JoinHostPort(h, "1")
+}
+
+type truncatingWriter struct {
+	http.ResponseWriter
+	limit   int
+	written int
+}
+
+func (t *truncatingWriter) Write(b []byte) (int, error) {
+	if t.limit <= 0 {
+		// A zero (or negative) limit means "truncate before any body bytes
+		// go out" - hijack-and-close here too, or the connection closes
+		// cleanly and the client sees a well-formed empty-body response
+		// instead of the EOF this policy promises.
+		t.hijackAndClose()
+		return 0, io.EOF
+	}
+	if t.written >= t.limit {
+		return 0, io.EOF
+	}
+	if remaining := t.limit - t.written; len(b) > remaining {
+		b = b[:remaining]
+	}
+	n, err := t.ResponseWriter.Write(b)
+	t.written += n
+	if t.written >= t.limit {
+		t.hijackAndClose()
+	}
+	return n, err
+}
+
+func (t *truncatingWriter) hijackAndClose() {
+	if hj, ok := t.ResponseWriter.(http.Hijacker); ok {
+		if conn, _, err := hj.Hijack(); err == nil {
+			_ = conn.Close()
+		}
+	}
+}
+
+func rollLatency(p LatencyPolicy) (bool, int64) {
+	if p.MeanMs <= 0 {
+		return false, 0
+	}
+	var ms float64
+	switch p.Distribution {
+	case DistNormal:
+		ms = rand.NormFloat64()*p.StdDevMs + p.MeanMs
+	case DistLognormal:
+		// underlying normal's parameters chosen so samples have mean MeanMs
+		// and standard deviation StdDevMs.
+		sigma2 := math.Log(1 + (p.StdDevMs*p.StdDevMs)/(p.MeanMs*p.MeanMs))
+		ms = math.Exp(rand.NormFloat64()*math.Sqrt(sigma2) + math.Log(p.MeanMs) - sigma2/2)
+	case DistPareto:
+		// shape chosen so samples have standard deviation StdDevMs (1.5, with
+		// unbounded variance, when StdDevMs <= 0), scale so they have mean MeanMs.
+		alpha := 1.5
+		if p.StdDevMs > 0 {
+			alpha = 1 + math.Sqrt(1+(p.MeanMs*p.MeanMs)/(p.StdDevMs*p.StdDevMs))
+		}
+		ms = p.MeanMs * (alpha - 1) / alpha / math.Pow(1-rand.Float64(), 1/alpha)
+	default:
+		ms = rand.Float64() * 2 * p.MeanMs
+	}
+	if ms < 0 {
+		ms = 0
+	}
+	return true, int64(ms)
+}
+
+func rollError(p ErrorPolicy) (bool, int) {
+	if p.Rate <= 0 || len(p.Weights) == 0 {
+		return false, 0
+	}
+	if rand.Float64() >= p.Rate {
+		return false, 0
+	}
+
+	var total float64
+	for _, w := range p.Weights {
+		total += w
+	}
+	if total <= 0 {
+		return false, 0
+	}
+
+	r := rand.Float64() * total
+	var cum float64
+	for status, w := range p.Weights {
+		cum += w
+		if r <= cum {
+			return true, status
+		}
+	}
+	for status := range p.Weights {
+		return true, status
+	}
+	return false, 0
+}
+
+func rollTruncate(p TruncatePolicy) (bool, int) {
+	if p.Rate <= 0 {
+		return false, 0
+	}
+	if rand.Float64() >= p.Rate {
+		return false, 0
+	}
+	n := p.MinBytes
+	if p.MaxBytes > p.MinBytes {
+		n += rand.Intn(p.MaxBytes - p.MinBytes)
+	}
+	return true, n
+}
+
+func rollConnFail(p ConnFailPolicy) bool {
+	return p.Rate > 0 && rand.Float64() < p.Rate
+}
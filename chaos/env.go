@@ -0,0 +1,123 @@
+package chaos
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	envLatencyDistribution = "CHAOS_LATENCY_DISTRIBUTION"
+	envLatencyMeanMs       = "CHAOS_LATENCY_MEAN_MS"
+	envLatencyStdDevMs     = "CHAOS_LATENCY_STDDEV_MS"
+	envErrorRate           = "CHAOS_ERROR_RATE"
+	envErrorStatuses       = "CHAOS_ERROR_STATUSES"
+	envTruncateRate        = "CHAOS_TRUNCATE_RATE"
+	envTruncateMinBytes    = "CHAOS_TRUNCATE_MIN_BYTES"
+	envTruncateMaxBytes    = "CHAOS_TRUNCATE_MAX_BYTES"
+	envConnFailRate        = "CHAOS_CONN_FAIL_RATE"
+)
+
+// PolicyFromEnv builds the initial Policy from CHAOS_* env vars. Everything
+// defaults to disabled except latency, which keeps the app's historical
+// behaviour of sleeping 0-1000ms uniformly on every /unstable call.
+func PolicyFromEnv(l *zap.Logger) Policy {
+	return Policy{
+		Latency: LatencyPolicy{
+			Distribution: Distribution(getenv(envLatencyDistribution, string(DistUniform))),
+			MeanMs:       getenvFloat(l, envLatencyMeanMs, 500),
+			StdDevMs:     getenvFloat(l, envLatencyStdDevMs, 150),
+		},
+		Error: ErrorPolicy{
+			Rate:    getenvFloat(l, envErrorRate, 0),
+			Weights: parseWeights(l, getenv(envErrorStatuses, "")),
+		},
+		Truncate: TruncatePolicy{
+			Rate:     getenvFloat(l, envTruncateRate, 0),
+			MinBytes: int(getenvFloat(l, envTruncateMinBytes, 0)),
+			MaxBytes: int(getenvFloat(l, envTruncateMaxBytes, 0)),
+		},
+		ConnFail: ConnFailPolicy{
+			Rate: getenvFloat(l, envConnFailRate, 0),
+		},
+	}
+}
+
+// AdminHandler serves GET /admin/chaos (dump the active policy as JSON) and
+// POST /admin/chaos (replace it with the JSON body), so the fault profile
+// can be tuned against a running instance without a restart.
+func AdminHandler(store *Store, l *zap.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(store.Load()); err != nil {
+				l.Error("could not encode chaos policy", zap.Error(err))
+			}
+		case http.MethodPost:
+			var p Policy
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				l.Warn("could not decode chaos policy", zap.Error(err))
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			store.Set(p)
+			l.Info("chaos policy reloaded", zap.Any("policy", p))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getenvFloat(l *zap.Logger, key string, fallback float64) float64 {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		l.Warn("invalid float env var, using default", zap.String("key", key), zap.String("value", raw), zap.Error(err))
+		return fallback
+	}
+	return v
+}
+
+// parseWeights parses a "status:weight,status:weight" string, e.g.
+// "500:0.5,502:0.3,503:0.2", into a status->weight map.
+func parseWeights(l *zap.Logger, raw string) map[int]float64 {
+	weights := map[int]float64{}
+	if raw == "" {
+		return weights
+	}
+	for _, entry := range strings.Split(raw, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			l.Warn("invalid chaos error status weight, skipping", zap.String("entry", entry))
+			continue
+		}
+		status, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			l.Warn("invalid chaos error status, skipping", zap.String("entry", entry), zap.Error(err))
+			continue
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			l.Warn("invalid chaos error weight, skipping", zap.String("entry", entry), zap.Error(err))
+			continue
+		}
+		weights[status] = weight
+	}
+	return weights
+}
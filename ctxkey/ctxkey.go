@@ -0,0 +1,10 @@
+// Package ctxkey defines the typed keys used to store request-scoped values
+// on a context.Context, so packages don't collide on bare string keys.
+package ctxkey
+
+type key int
+
+const (
+	// CorrelationID holds the request's correlation id, as a string.
+	CorrelationID key = iota
+)
@@ -0,0 +1,119 @@
+// Package httpmw provides a small middleware pipeline for composing
+// http.Handlers, replacing hand-nested struct literals with a declarative
+// Use/Then chain.
+package httpmw
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/paluszkiewiczB/k6-grafana-stack/ctxkey"
+	"github.com/paluszkiewiczB/k6-grafana-stack/idgen"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// correlationBaggageKey is the W3C baggage member name carrying the
+// correlation id across service boundaries.
+const correlationBaggageKey = "correlation.id"
+
+// Decorator wraps an http.Handler with additional behaviour.
+type Decorator func(http.Handler) http.Handler
+
+// Pipeline is an ordered list of Decorators applied to a terminal handler.
+type Pipeline struct {
+	decorators []Decorator
+}
+
+// New builds a Pipeline from the given decorators, applied in the order
+// given: the first decorator is outermost and sees the request first.
+func New(d ...Decorator) *Pipeline {
+	return &Pipeline{decorators: d}
+}
+
+// Use appends more decorators to the pipeline.
+func (p *Pipeline) Use(d ...Decorator) *Pipeline {
+	p.decorators = append(p.decorators, d...)
+	return p
+}
+
+// Then wraps h with every decorator in the pipeline and returns the result.
+func (p *Pipeline) Then(h http.Handler) http.Handler {
+	for i := len(p.decorators) - 1; i >= 0; i-- {
+		h = p.decorators[i](h)
+	}
+	return h
+}
+
+// Router dispatches requests to a handler registered for their exact path,
+// falling back to notFound otherwise.
+type Router struct {
+	routes   map[string]http.Handler
+	notFound http.Handler
+}
+
+// NewRouter creates an empty Router that falls back to notFound for any
+// unregistered path.
+func NewRouter(notFound http.Handler) *Router {
+	return &Router{routes: map[string]http.Handler{}, notFound: notFound}
+}
+
+// Handle registers h for the exact path and returns the Router for chaining.
+func (r *Router) Handle(path string, h http.Handler) *Router {
+	r.routes[path] = h
+	return r
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h, ok := r.routes[req.URL.Path]
+	if !ok {
+		r.notFound.ServeHTTP(w, req)
+		return
+	}
+	h.ServeHTTP(w, req)
+}
+
+// TraceHTTP wraps the handler with otelhttp instrumentation under opName.
+func TraceHTTP(opName string) Decorator {
+	return func(next http.Handler) http.Handler {
+		return otelhttp.NewHandler(next, opName)
+	}
+}
+
+// CorrelationID ensures the request carries a correlation id, reusing the
+// "correlation.id" baggage member if one was propagated from upstream and
+// otherwise minting a UUIDv7 and injecting it into outgoing baggage (so an
+// outbound client using otelhttp.NewTransport forwards it automatically). Either way the
+// id is stashed under ctxkey.CorrelationID and set as a span attribute so
+// Tempo<->Loki correlation works in both directions.
+func CorrelationID(l *zap.Logger) Decorator {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			bag := baggage.FromContext(ctx)
+			cId := bag.Member(correlationBaggageKey).Value()
+
+			if cId == "" {
+				cId = idgen.NewUUIDv7()
+				member, err := baggage.NewMember(correlationBaggageKey, cId)
+				if err != nil {
+					l.Warn("could not create correlation id baggage member", zap.Error(err))
+				} else if newBag, err := bag.SetMember(member); err != nil {
+					l.Warn("could not set correlation id baggage member", zap.Error(err))
+				} else {
+					ctx = baggage.ContextWithBaggage(ctx, newBag)
+				}
+			} else {
+				l.Debug("correlation id present in baggage, not generating new one")
+			}
+
+			ctx = context.WithValue(ctx, ctxkey.CorrelationID, cId)
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String(correlationBaggageKey, cId))
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
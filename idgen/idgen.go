@@ -0,0 +1,33 @@
+// Package idgen mints request identifiers. Ids are UUIDv7 (RFC 9562): a
+// 48-bit millisecond timestamp prefix followed by random bits, so two ids
+// minted moments apart sort in the order they were created.
+package idgen
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// NewUUIDv7 returns a new UUIDv7 string, e.g. "0189f3f2-7e9a-7c1b-8a2e-3fbb19c7c9ad".
+func NewUUIDv7() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixMilli())
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+
+	if _, err := rand.Read(b[6:]); err != nil {
+		// crypto/rand is expected to always succeed; a failure here means the
+		// OS entropy source is broken, which we can't recover from.
+		panic(fmt.Sprintf("idgen: could not read random bytes: %v", err))
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x70 // version 7
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
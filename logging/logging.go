@@ -0,0 +1,121 @@
+// Package logging builds request-scoped loggers that are automatically
+// enriched with the correlation id and current span's TraceID/SpanID, and
+// bridges them to log/slog so libraries that log via slog (rather than zap
+// directly) produce output with the same fields.
+package logging
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/paluszkiewiczB/k6-grafana-stack/ctxkey"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/exp/zapslog"
+	"go.uber.org/zap/zapcore"
+)
+
+// CtxLogger extracts a *zap.Logger carrying the correlation id and current
+// span's TraceID/SpanID from a context.Context.
+type CtxLogger func(ctx context.Context) *zap.Logger
+
+// New builds a CtxLogger rooted at base. Every Error-level entry logged
+// through it also gets recorded as an event on the request's current span,
+// so Grafana's logs<->traces navigation works in both directions.
+func New(base *zap.Logger) CtxLogger {
+	return func(ctx context.Context) *zap.Logger {
+		span := trace.SpanFromContext(ctx)
+		l := base.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return &spanEventCore{Core: core, span: span}
+		}))
+
+		if cId, ok := ctx.Value(ctxkey.CorrelationID).(string); ok {
+			l = l.With(zap.String("correlationId", cId))
+		}
+		return l.With(
+			zap.String("TraceID", span.SpanContext().TraceID().String()),
+			zap.String("SpanID", span.SpanContext().SpanID().String()),
+		)
+	}
+}
+
+// SlogHandler returns a slog.Handler backed by the same CtxLogger used for
+// zap logging, so a library given this handler logs with the same
+// correlationId/TraceID/SpanID fields and log->trace correlation as the rest
+// of the app. Unlike wrapping a single zapslog.Handler built from one fixed
+// context, it re-derives the CtxLogger from the context passed to each Handle
+// call, so the fields stay correct across the lifetime of a long-lived
+// *slog.Logger handed a different ctx (and thus span/correlation id) per
+// call.
+func SlogHandler(base *zap.Logger) slog.Handler {
+	return &ctxSlogHandler{base: base}
+}
+
+// ctxSlogHandler defers building the underlying zapslog.Handler until each
+// call, since that's the only point a per-request ctx is available. WithAttrs
+// and WithGroup calls are replayed against that fresh handler in the order
+// they were received, so group/attr semantics match a handler built once.
+type ctxSlogHandler struct {
+	base *zap.Logger
+	wrap []func(slog.Handler) slog.Handler
+}
+
+func (h *ctxSlogHandler) delegate(ctx context.Context) slog.Handler {
+	d := slog.Handler(zapslog.NewHandler(New(h.base)(ctx).Core()))
+	for _, fn := range h.wrap {
+		d = fn(d)
+	}
+	return d
+}
+
+func (h *ctxSlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.delegate(ctx).Enabled(ctx, level)
+}
+
+func (h *ctxSlogHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.delegate(ctx).Handle(ctx, record)
+}
+
+func (h *ctxSlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.clone(func(d slog.Handler) slog.Handler { return d.WithAttrs(attrs) })
+}
+
+func (h *ctxSlogHandler) WithGroup(name string) slog.Handler {
+	return h.clone(func(d slog.Handler) slog.Handler { return d.WithGroup(name) })
+}
+
+func (h *ctxSlogHandler) clone(fn func(slog.Handler) slog.Handler) *ctxSlogHandler {
+	wrap := make([]func(slog.Handler) slog.Handler, len(h.wrap)+1)
+	copy(wrap, h.wrap)
+	wrap[len(h.wrap)] = fn
+	return &ctxSlogHandler{base: h.base, wrap: wrap}
+}
+
+// spanEventCore wraps a zapcore.Core to additionally record every Error-level
+// entry as an event on span.
+type spanEventCore struct {
+	zapcore.Core
+	span trace.Span
+}
+
+func (c *spanEventCore) With(fields []zapcore.Field) zapcore.Core {
+	return &spanEventCore{Core: c.Core.With(fields), span: c.span}
+}
+
+func (c *spanEventCore) Check(entry zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return ce.AddCore(entry, c)
+	}
+	return ce
+}
+
+func (c *spanEventCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	if entry.Level == zapcore.ErrorLevel && c.span.SpanContext().IsValid() {
+		c.span.AddEvent("log", trace.WithAttributes(
+			attribute.String("log.level", entry.Level.String()),
+			attribute.String("log.message", entry.Message),
+		))
+	}
+	return c.Core.Write(entry, fields)
+}
@@ -0,0 +1,137 @@
+// Package metrics registers the app's RED (rate/errors/duration) metrics and
+// the middleware/transport that feed them, so every route and outbound call
+// produces a comparable set of series with trace exemplars attached.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/paluszkiewiczB/k6-grafana-stack/httpmw"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	ServerRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "http",
+		Subsystem: "server",
+		Name:      "requests_total",
+		Help:      "Total number of HTTP server requests.",
+	}, []string{"route", "method", "status"})
+
+	ServerRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                   "http",
+		Subsystem:                   "server",
+		Name:                        "request_duration_seconds",
+		Help:                        "Duration of HTTP server requests in seconds.",
+		Buckets:                     prometheus.DefBuckets,
+		NativeHistogramBucketFactor: 1.1,
+	}, []string{"route", "method", "status"})
+
+	ClientRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "http",
+		Subsystem: "client",
+		Name:      "requests_total",
+		Help:      "Total number of outbound HTTP requests.",
+	}, []string{"route", "method", "status"})
+
+	ClientRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:                   "http",
+		Subsystem:                   "client",
+		Name:                        "request_duration_seconds",
+		Help:                        "Duration of outbound HTTP requests in seconds.",
+		Buckets:                     prometheus.DefBuckets,
+		NativeHistogramBucketFactor: 1.1,
+	}, []string{"route", "method", "status"})
+)
+
+// MustRegister registers every RED metric with reg, panicking on failure -
+// the same convention prometheus.MustRegister uses.
+func MustRegister(reg prometheus.Registerer) {
+	reg.MustRegister(ServerRequestsTotal, ServerRequestDuration, ClientRequestsTotal, ClientRequestDuration)
+}
+
+// RED instruments a handler with the http_server_* RED metrics for route,
+// capturing the response status via a ResponseWriter wrapper.
+func RED(route string) httpmw.Decorator {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+			next.ServeHTTP(sw, r)
+
+			labels := prometheus.Labels{
+				"route":  route,
+				"method": r.Method,
+				"status": strconv.Itoa(sw.status),
+			}
+			ServerRequestsTotal.With(labels).Inc()
+			observeWithExemplar(ServerRequestDuration.With(labels), time.Since(start).Seconds(), r.Context())
+		})
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack forwards to the wrapped ResponseWriter's http.Hijacker, since
+// embedding the http.ResponseWriter interface alone doesn't promote Hijack -
+// it's not part of that interface. Without this, wrapping a statusWriter
+// again (e.g. chaos.truncatingWriter) can never hijack the connection, no
+// matter what the real underlying writer supports.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// InstrumentRoundTripper wraps base with the http_client_* RED metrics for
+// route.
+func InstrumentRoundTripper(route string, base http.RoundTripper) http.RoundTripper {
+	return &roundTripper{route: route, base: base}
+}
+
+type roundTripper struct {
+	route string
+	base  http.RoundTripper
+}
+
+func (rt *roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := rt.base.RoundTrip(r)
+
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	labels := prometheus.Labels{"route": rt.route, "method": r.Method, "status": status}
+	ClientRequestsTotal.With(labels).Inc()
+	observeWithExemplar(ClientRequestDuration.With(labels), time.Since(start).Seconds(), r.Context())
+
+	return resp, err
+}
+
+func observeWithExemplar(o prometheus.Observer, seconds float64, ctx context.Context) {
+	span := trace.SpanFromContext(ctx)
+	eo, ok := o.(prometheus.ExemplarObserver)
+	if !ok || !span.SpanContext().IsValid() {
+		o.Observe(seconds)
+		return
+	}
+	eo.ObserveWithExemplar(seconds, prometheus.Labels{"traceId": span.SpanContext().TraceID().String()})
+}
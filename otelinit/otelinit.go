@@ -0,0 +1,298 @@
+// Package otelinit builds the trace and metric providers for the app from
+// the standard OTel SDK environment variables, so the exporters can be
+// pointed at a real collector (Tempo/Alloy) without recompiling.
+package otelinit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	envProtocol    = "OTEL_EXPORTER_OTLP_PROTOCOL"
+	envEndpoint    = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	envHeaders     = "OTEL_EXPORTER_OTLP_HEADERS"
+	envCompression = "OTEL_EXPORTER_OTLP_COMPRESSION"
+	envInsecure    = "OTEL_EXPORTER_OTLP_INSECURE"
+	envCertificate = "OTEL_EXPORTER_OTLP_CERTIFICATE"
+	envServiceName = "OTEL_SERVICE_NAME"
+
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+
+	defaultEndpoint = "localhost:4317"
+	defaultProtocol = ProtocolGRPC
+)
+
+// Config mirrors the subset of standard OTel SDK environment variables this
+// app honours. Use ConfigFromEnv to build one from the process environment.
+type Config struct {
+	Protocol        string
+	Endpoint        string
+	Headers         map[string]string
+	Compression     string
+	Insecure        bool
+	CertificateFile string
+	ServiceName     string
+}
+
+// ConfigFromEnv reads the OTEL_EXPORTER_OTLP_* / OTEL_SERVICE_NAME env vars,
+// falling back to a gRPC exporter against localhost:4317 when unset.
+func ConfigFromEnv(l *zap.Logger) Config {
+	cfg := Config{
+		Protocol:        strings.ToLower(getenv(envProtocol, defaultProtocol)),
+		Endpoint:        getenv(envEndpoint, defaultEndpoint),
+		Headers:         parseHeaders(getenv(envHeaders, "")),
+		Compression:     strings.ToLower(getenv(envCompression, "")),
+		CertificateFile: getenv(envCertificate, ""),
+		ServiceName:     getenv(envServiceName, "k6gpt"),
+	}
+	if insecure, err := strconv.ParseBool(getenv(envInsecure, "true")); err == nil {
+		cfg.Insecure = insecure
+	} else {
+		l.Warn("invalid OTEL_EXPORTER_OTLP_INSECURE, defaulting to true", zap.Error(err))
+		cfg.Insecure = true
+	}
+	if cfg.Protocol != ProtocolGRPC && cfg.Protocol != ProtocolHTTP {
+		l.Warn("unsupported OTEL_EXPORTER_OTLP_PROTOCOL, defaulting to grpc", zap.String("protocol", cfg.Protocol))
+		cfg.Protocol = ProtocolGRPC
+	}
+	return cfg
+}
+
+// tlsConfig builds the *tls.Config an exporter should dial with: the system
+// root CAs by default, or certFile's pool when set, so the collector can be
+// reached over TLS with a private CA rather than only insecure or
+// public-CA endpoints.
+func tlsConfig(certFile string) (*tls.Config, error) {
+	if certFile == "" {
+		return &tls.Config{}, nil
+	}
+	pemBytes, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", envCertificate, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no valid certificates found in %s", certFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Providers bundles the tracer and meter providers produced by Init, along
+// with a Shutdown func that flushes and closes both.
+type Providers struct {
+	TracerProvider *sdktrace.TracerProvider
+	MeterProvider  *sdkmetric.MeterProvider
+	Shutdown       func(ctx context.Context) error
+}
+
+// Init builds a TracerProvider and MeterProvider from cfg, registers them as
+// the global providers, and arranges for both to flush and shut down
+// together when ctx is cancelled.
+func Init(ctx context.Context, l *zap.Logger, cfg Config) (*Providers, error) {
+	res := resource.NewSchemaless(
+		attribute.String("service.name", cfg.ServiceName),
+		// dummy hardcoded attributes to allow for traces to logs correlation
+		// span attributes are used in LogQL query and must match log labels
+		attribute.String("job", "promtail"),
+		attribute.String("container", "k6-grafana-prometheus-tempo_app_1"),
+	)
+
+	traceExporter, err := newTraceExporter(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace exporter: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+		sdktrace.WithBatcher(traceExporter),
+		sdktrace.WithResource(res),
+	)
+
+	metricExporter, err := newMetricExporter(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create metric exporter: %w", err)
+	}
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)),
+		sdkmetric.WithResource(res),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	shutdown := func(shutCtx context.Context) error {
+		var errs []error
+		if err := tp.Shutdown(shutCtx); err != nil {
+			errs = append(errs, fmt.Errorf("tracer provider: %w", err))
+		}
+		if err := mp.Shutdown(shutCtx); err != nil {
+			errs = append(errs, fmt.Errorf("meter provider: %w", err))
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("otelinit shutdown: %v", errs)
+		}
+		return nil
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Info("shutting down otel providers")
+		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(shutCtx); err != nil {
+			l.Error("could not shutdown otel providers", zap.Error(err))
+		}
+	}()
+
+	return &Providers{TracerProvider: tp, MeterProvider: mp, Shutdown: shutdown}, nil
+}
+
+func newTraceExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, error) {
+	if cfg.Protocol == ProtocolHTTP {
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(cfg.Endpoint),
+			otlptracehttp.WithHeaders(cfg.Headers),
+			otlptracehttp.WithRetry(otlptracehttp.RetryConfig{
+				Enabled:         true,
+				InitialInterval: 1 * time.Second,
+				MaxInterval:     30 * time.Second,
+				MaxElapsedTime:  1 * time.Minute,
+			}),
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		} else {
+			tlsCfg, err := tlsConfig(cfg.CertificateFile)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsCfg))
+		}
+		if cfg.Compression == "gzip" {
+			opts = append(opts, otlptracehttp.WithCompression(otlptracehttp.GzipCompression))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	opts := []otlptracegrpc.Option{
+		otlptracegrpc.WithEndpoint(cfg.Endpoint),
+		otlptracegrpc.WithHeaders(cfg.Headers),
+		otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: 1 * time.Second,
+			MaxInterval:     30 * time.Second,
+			MaxElapsedTime:  1 * time.Minute,
+		}),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else {
+		tlsCfg, err := tlsConfig(cfg.CertificateFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsCfg)))
+	}
+	if cfg.Compression == "gzip" {
+		opts = append(opts, otlptracegrpc.WithCompressor("gzip"))
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+func newMetricExporter(ctx context.Context, cfg Config) (sdkmetric.Exporter, error) {
+	if cfg.Protocol == ProtocolHTTP {
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(cfg.Endpoint),
+			otlpmetrichttp.WithHeaders(cfg.Headers),
+			otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig{
+				Enabled:         true,
+				InitialInterval: 1 * time.Second,
+				MaxInterval:     30 * time.Second,
+				MaxElapsedTime:  1 * time.Minute,
+			}),
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		} else {
+			tlsCfg, err := tlsConfig(cfg.CertificateFile)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(tlsCfg))
+		}
+		if cfg.Compression == "gzip" {
+			opts = append(opts, otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(cfg.Endpoint),
+		otlpmetricgrpc.WithHeaders(cfg.Headers),
+		otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig{
+			Enabled:         true,
+			InitialInterval: 1 * time.Second,
+			MaxInterval:     30 * time.Second,
+			MaxElapsedTime:  1 * time.Minute,
+		}),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	} else {
+		tlsCfg, err := tlsConfig(cfg.CertificateFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsCfg)))
+	}
+	if cfg.Compression == "gzip" {
+		opts = append(opts, otlpmetricgrpc.WithCompressor("gzip"))
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+func parseHeaders(raw string) map[string]string {
+	headers := map[string]string{}
+	if raw == "" {
+		return headers
+	}
+	for _, kv := range strings.Split(raw, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers
+}